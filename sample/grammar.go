@@ -0,0 +1,423 @@
+package sample
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp/syntax"
+)
+
+// GrammarState is one node of a byte-level acceptor: it reports which
+// bytes can legally come next, and what state follows once one of them is
+// consumed.
+type GrammarState interface {
+	// Accepts reports whether b could extend the current parse.
+	Accepts(b byte) bool
+	// Advance returns the state that follows after consuming b. It is
+	// only ever called when Accepts(b) is true.
+	Advance(b byte) GrammarState
+}
+
+// byteTrieNode is a node of a trie built once from the tokenizer
+// vocabulary, mapping byte sequences back to the token ids that produce
+// them. Grammar intersects this trie with a GrammarState to find the
+// allowed tokens for a given call to Sample in time proportional to the
+// number of allowed tokens, rather than the size of the vocabulary.
+type byteTrieNode struct {
+	children map[byte]*byteTrieNode
+	tokenIDs []int
+}
+
+func newByteTrie(vocab []string) *byteTrieNode {
+	root := &byteTrieNode{children: make(map[byte]*byteTrieNode)}
+	for tokenID, token := range vocab {
+		n := root
+		for i := 0; i < len(token); i++ {
+			b := token[i]
+			child, ok := n.children[b]
+			if !ok {
+				child = &byteTrieNode{children: make(map[byte]*byteTrieNode)}
+				n.children[b] = child
+			}
+			n = child
+		}
+		n.tokenIDs = append(n.tokenIDs, tokenID)
+	}
+	return root
+}
+
+// Grammar is a Sampler that masks out logits for tokens whose byte
+// sequence cannot extend any currently valid parse, as judged by a
+// GrammarState. This package provides states for JSON documents
+// (NewJSONGrammar) and regular expressions (NewRegexGrammar); it has no
+// parser for GBNF or other context-free grammar notations. It is
+// stateful: Accept must be called with whichever token id was ultimately
+// chosen so the grammar's parse state advances alongside generation.
+type Grammar struct {
+	vocab []string
+	root  *byteTrieNode
+	state GrammarState
+
+	// allowed memoizes, per grammar state, the token ids whose full byte
+	// sequence the state currently accepts.
+	allowed map[GrammarState][]int
+}
+
+// newGrammar builds a Grammar over vocab (token id -> token bytes),
+// starting in state start.
+func newGrammar(vocab []string, start GrammarState) *Grammar {
+	return &Grammar{
+		vocab:   vocab,
+		root:    newByteTrie(vocab),
+		state:   start,
+		allowed: make(map[GrammarState][]int),
+	}
+}
+
+func (g *Grammar) allowedTokens(state GrammarState) []int {
+	if ids, ok := g.allowed[state]; ok {
+		return ids
+	}
+
+	var ids []int
+	var walk func(node *byteTrieNode, state GrammarState)
+	walk = func(node *byteTrieNode, state GrammarState) {
+		ids = append(ids, node.tokenIDs...)
+		for b, child := range node.children {
+			if state.Accepts(b) {
+				walk(child, state.Advance(b))
+			}
+		}
+	}
+	walk(g.root, state)
+
+	g.allowed[state] = ids
+	return ids
+}
+
+func (g *Grammar) Sample(logits []float64) ([]float64, error) {
+	mask := make([]bool, len(logits))
+	for _, id := range g.allowedTokens(g.state) {
+		if id >= 0 && id < len(logits) {
+			mask[id] = true
+		}
+	}
+
+	for i := range logits {
+		if !mask[i] {
+			logits[i] = math.NaN()
+		}
+	}
+
+	return logits, nil
+}
+
+// Accept advances the grammar's parse state by the bytes of tokenID. It
+// should be called, after a terminal sampler has picked a token, with
+// whichever token id was chosen.
+func (g *Grammar) Accept(tokenID int) error {
+	if tokenID < 0 || tokenID >= len(g.vocab) {
+		return errors.New("grammar: unknown token id")
+	}
+
+	token := g.vocab[tokenID]
+	for i := 0; i < len(token); i++ {
+		b := token[i]
+		if !g.state.Accepts(b) {
+			return fmt.Errorf("grammar: token %d is not valid in the current state", tokenID)
+		}
+		g.state = g.state.Advance(b)
+	}
+	return nil
+}
+
+// jsonState is a hand-rolled byte-level acceptor for JSON documents (RFC
+// 8259), tracking open objects/arrays on a stack alongside what is
+// expected to come next within the current one.
+type jsonState struct {
+	mode        jsonMode
+	literal     string // remaining bytes of a "true"/"false"/"null" literal
+	stringIsKey bool   // whether the in-progress string is an object key
+	stack       []jsonFrame
+}
+
+type jsonMode int
+
+const (
+	jsonModeRoot  jsonMode = iota // only an object or array may open the document
+	jsonModeValue                 // a value (or the start of one) is expected
+	jsonModeLiteral
+	jsonModeString
+	jsonModeStringEscape
+	jsonModeNumber
+	jsonModeAfterValue // a value was just completed; expect , or closing bracket
+	jsonModeObjectKey  // expect a string starting a key, or }
+	jsonModeAfterKey   // expect :
+)
+
+type jsonFrame byte // '{' or '['
+
+// NewJSONGrammar returns a Grammar that only allows tokens which keep the
+// generated text a valid (possibly incomplete) JSON document. The document
+// must be an object or array: while RFC 8259 permits any value at the top
+// level, constrained decoding callers almost always want a structured
+// document rather than a bare string, number, or literal.
+//
+// Nesting, keys, colons, commas and literals are checked byte by byte, but
+// number and string contents only loosely: a number is any run of digits,
+// '.', 'e', 'E', '+' and '-' starting with a digit or '-'; inside a string
+// any byte but NUL is allowed, and the hex digits after \u are not checked.
+// An empty array, [], is not accepted: an array must hold at least one
+// value.
+func NewJSONGrammar(vocab []string) *Grammar {
+	return newGrammar(vocab, &jsonState{mode: jsonModeRoot})
+}
+
+func isJSONSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+func (s *jsonState) Accepts(b byte) bool {
+	switch s.mode {
+	case jsonModeRoot:
+		return isJSONSpace(b) || b == '{' || b == '['
+	case jsonModeValue, jsonModeObjectKey:
+		if isJSONSpace(b) {
+			return true
+		}
+		if s.mode == jsonModeObjectKey {
+			return b == '"' || (b == '}' && len(s.stack) > 0 && s.stack[len(s.stack)-1] == '{')
+		}
+		switch b {
+		case '"', '{', '[', '-':
+			return true
+		case 't', 'f', 'n':
+			return true
+		default:
+			return isDigit(b)
+		}
+	case jsonModeLiteral:
+		return len(s.literal) > 0 && b == s.literal[0]
+	case jsonModeString:
+		return b != 0
+	case jsonModeStringEscape:
+		switch b {
+		case '"', '\\', '/', 'b', 'f', 'n', 'r', 't', 'u':
+			return true
+		default:
+			return false
+		}
+	case jsonModeNumber:
+		if isDigit(b) || b == '.' || b == 'e' || b == 'E' || b == '+' || b == '-' {
+			return true
+		}
+		// any other byte ends the number and must be valid after a value
+		after := *s
+		after.mode = jsonModeAfterValue
+		return after.Accepts(b)
+	case jsonModeAfterValue:
+		if isJSONSpace(b) {
+			return true
+		}
+		if len(s.stack) == 0 {
+			return false
+		}
+		top := s.stack[len(s.stack)-1]
+		switch top {
+		case '{':
+			return b == ',' || b == '}'
+		case '[':
+			return b == ',' || b == ']'
+		}
+		return false
+	case jsonModeAfterKey:
+		return isJSONSpace(b) || b == ':'
+	}
+	return false
+}
+
+func (s *jsonState) Advance(b byte) GrammarState {
+	next := *s
+	next.stack = append([]jsonFrame(nil), s.stack...)
+
+	switch s.mode {
+	case jsonModeRoot:
+		if isJSONSpace(b) {
+			return &next
+		}
+		switch b {
+		case '{':
+			next.stack = append(next.stack, '{')
+			next.mode = jsonModeObjectKey
+		case '[':
+			next.stack = append(next.stack, '[')
+			next.mode = jsonModeValue
+		}
+	case jsonModeValue, jsonModeObjectKey:
+		if isJSONSpace(b) {
+			return &next
+		}
+		switch b {
+		case '}':
+			next.stack = next.stack[:len(next.stack)-1]
+			next.mode = jsonModeAfterValue
+		case '"':
+			next.mode = jsonModeString
+			next.stringIsKey = s.mode == jsonModeObjectKey
+		case '{':
+			next.stack = append(next.stack, '{')
+			next.mode = jsonModeObjectKey
+		case '[':
+			next.stack = append(next.stack, '[')
+			next.mode = jsonModeValue
+		case '-':
+			next.mode = jsonModeNumber
+		case 't':
+			next.mode, next.literal = jsonModeLiteral, "rue"
+		case 'f':
+			next.mode, next.literal = jsonModeLiteral, "alse"
+		case 'n':
+			next.mode, next.literal = jsonModeLiteral, "ull"
+		default:
+			next.mode = jsonModeNumber
+		}
+	case jsonModeLiteral:
+		next.literal = s.literal[1:]
+		if next.literal == "" {
+			next.mode = jsonModeAfterValue
+		}
+	case jsonModeString:
+		switch b {
+		case '"':
+			if s.stringIsKey {
+				next.mode = jsonModeAfterKey
+			} else {
+				next.mode = jsonModeAfterValue
+			}
+		case '\\':
+			next.mode = jsonModeStringEscape
+		}
+	case jsonModeStringEscape:
+		next.mode = jsonModeString
+	case jsonModeNumber:
+		if !(isDigit(b) || b == '.' || b == 'e' || b == 'E' || b == '+' || b == '-') {
+			// the byte that ends the number is consumed as whatever
+			// follows a completed value
+			next.mode = jsonModeAfterValue
+			return next.Advance(b)
+		}
+	case jsonModeAfterValue:
+		if isJSONSpace(b) {
+			return &next
+		}
+		switch b {
+		case ',':
+			top := s.stack[len(s.stack)-1]
+			if top == '{' {
+				next.mode = jsonModeObjectKey
+			} else {
+				next.mode = jsonModeValue
+			}
+		case '}', ']':
+			next.stack = next.stack[:len(next.stack)-1]
+			next.mode = jsonModeAfterValue
+		}
+	case jsonModeAfterKey:
+		if b == ':' {
+			next.mode = jsonModeValue
+		}
+	}
+	return &next
+}
+
+// regexState is a byte-level acceptor for a compiled regular expression,
+// simulated as a set of live threads (epsilon-closed program counters)
+// through the regexp/syntax bytecode, the same representation the
+// standard library's own backtracking engine builds from. It is limited
+// to ASCII patterns: each byte is matched as its own rune.
+type regexState struct {
+	prog    *syntax.Prog
+	threads []uint32 // epsilon-closed set of live program counters
+}
+
+// NewRegexGrammar returns a Grammar that only allows tokens which keep the
+// generated text a valid (possibly incomplete) match of pat. pat is
+// anchored at the start; patterns are assumed to be ASCII.
+func NewRegexGrammar(vocab []string, pat string) (*Grammar, error) {
+	re, err := syntax.Parse(pat, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	// Compile does not handle counted repetition such as a{2,3}; Simplify
+	// rewrites it into forms Compile does handle
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return nil, err
+	}
+
+	start := &regexState{prog: prog}
+	start.threads = start.closure([]uint32{uint32(prog.Start)}, nil)
+	return newGrammar(vocab, start), nil
+}
+
+// closure follows Nop/Alt/AltMatch/Capture/EmptyWidth instructions to the
+// set of instructions that are actually waiting to consume a byte or
+// match, memoizing visited program counters in seen to avoid looping on
+// cyclic (star/plus) programs.
+func (s *regexState) closure(pcs []uint32, seen map[uint32]bool) []uint32 {
+	if seen == nil {
+		seen = make(map[uint32]bool)
+	}
+
+	var out []uint32
+	for _, pc := range pcs {
+		if seen[pc] {
+			continue
+		}
+		seen[pc] = true
+
+		inst := s.prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstAlt, syntax.InstAltMatch:
+			out = append(out, s.closure([]uint32{inst.Out, inst.Arg}, seen)...)
+		case syntax.InstNop, syntax.InstEmptyWidth, syntax.InstCapture:
+			out = append(out, s.closure([]uint32{inst.Out}, seen)...)
+		case syntax.InstFail:
+			// dead end
+		default:
+			out = append(out, pc)
+		}
+	}
+	return out
+}
+
+func (s *regexState) Accepts(b byte) bool {
+	for _, pc := range s.threads {
+		inst := s.prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+			if inst.MatchRune(rune(b)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *regexState) Advance(b byte) GrammarState {
+	var next []uint32
+	for _, pc := range s.threads {
+		inst := s.prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+			if inst.MatchRune(rune(b)) {
+				next = append(next, inst.Out)
+			}
+		}
+	}
+	return &regexState{prog: s.prog, threads: s.closure(next, nil)}
+}
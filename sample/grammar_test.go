@@ -0,0 +1,64 @@
+package sample
+
+import (
+	"math"
+	"testing"
+)
+
+func TestJSONGrammar(t *testing.T) {
+	// token 0: `{`, token 1: `"`, token 2: `1`, token 3: `}`
+	vocab := []string{"{", `"`, "1", "}"}
+	g := NewJSONGrammar(vocab)
+
+	logits, err := g.Sample([]float64{1, 1, 1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only `{` can start a JSON document from this vocabulary
+	for i, want := range []bool{true, false, false, false} {
+		if got := !math.IsNaN(logits[i]); got != want {
+			t.Errorf("token %d allowed = %v, want %v", i, got, want)
+		}
+	}
+
+	if err := g.Accept(0); err != nil {
+		t.Fatal(err)
+	}
+	logits, err = g.Sample([]float64{1, 1, 1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// after `{` only a key-opening quote (or a closing brace) is allowed
+	for i, want := range []bool{false, true, false, true} {
+		if got := !math.IsNaN(logits[i]); got != want {
+			t.Errorf("token %d allowed = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestRegexGrammar(t *testing.T) {
+	vocab := []string{"a", "b"}
+	g, err := NewRegexGrammar(vocab, "ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logits, err := g.Sample([]float64{1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.IsNaN(logits[0]) || !math.IsNaN(logits[1]) {
+		t.Fatalf("expected only 'a' to be allowed first, got %v", logits)
+	}
+
+	if err := g.Accept(0); err != nil {
+		t.Fatal(err)
+	}
+	logits, err = g.Sample([]float64{1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !math.IsNaN(logits[0]) || math.IsNaN(logits[1]) {
+		t.Fatalf("expected only 'b' to be allowed second, got %v", logits)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"math"
 	"slices"
 
+	"golang.org/x/exp/rand"
+
 	"gonum.org/v1/gonum/floats"
 	"gonum.org/v1/gonum/stat/sampleuv"
 )
@@ -14,6 +16,21 @@ type Sampler interface {
 	Sample([]float64) ([]float64, error)
 }
 
+// StatefulSampler is implemented by samplers that carry state across calls
+// to Sample, such as an adaptive truncation threshold derived from
+// previously chosen tokens. Once a terminal sampler in the chain (e.g.
+// Weighed or Greedy) has collapsed the logits down to a single chosen token
+// id, the top-level Sample driver calls Accept on every StatefulSampler in
+// the chain so it can fold that choice into its state.
+type StatefulSampler interface {
+	Sampler
+
+	// Accept updates the sampler's state to reflect that tokenID was the
+	// token ultimately chosen for the call to Sample that sampler took
+	// part in.
+	Accept(tokenID int) error
+}
+
 type Temperature float64
 
 func (t Temperature) Sample(logits []float64) ([]float64, error) {
@@ -55,6 +72,48 @@ func computeSoftmax(logits []float64) ([]float64, error) {
 	return copiedLogits, nil
 }
 
+// quickselectDesc partitions values in-place, in expected O(len(values))
+// time, so that the k largest values end up somewhere in values[:k] (in no
+// particular order), and returns the k-th largest value, i.e. the value
+// that ends up at values[k-1]. This is the nth_element idiom: it avoids
+// fully sorting values just to find a cutoff.
+func quickselectDesc(values []float64, k int) float64 {
+	lo, hi := 0, len(values)-1
+	for {
+		if lo == hi {
+			return values[lo]
+		}
+		p := partitionDesc(values, lo, hi, lo+(hi-lo)/2)
+		switch {
+		case p == k-1:
+			return values[p]
+		case p < k-1:
+			lo = p + 1
+		default:
+			hi = p - 1
+		}
+	}
+}
+
+// partitionDesc performs a Lomuto partition of values[lo:hi] (inclusive)
+// around values[pivotIdx], descending, and returns the pivot's final
+// resting index.
+func partitionDesc(values []float64, lo, hi, pivotIdx int) int {
+	pivot := values[pivotIdx]
+	values[pivotIdx], values[hi] = values[hi], values[pivotIdx]
+
+	store := lo
+	for i := lo; i < hi; i++ {
+		if values[i] > pivot {
+			values[i], values[store] = values[store], values[i]
+			store++
+		}
+	}
+
+	values[store], values[hi] = values[hi], values[store]
+	return store
+}
+
 type TopK int
 
 func (k TopK) Sample(logits []float64) ([]float64, error) {
@@ -65,18 +124,28 @@ func (k TopK) Sample(logits []float64) ([]float64, error) {
 		return logits, nil
 	}
 
-	indices := make([]int, len(logits))
-	for i := range indices {
-		indices[i] = i
-	}
+	values := make([]float64, len(logits))
+	copy(values, logits)
+	threshold := quickselectDesc(values, int(k))
 
-	// sort in descending order
-	slices.SortFunc(indices, func(i, j int) int {
-		return cmp.Compare(logits[j], logits[i])
-	})
+	// values exactly at threshold may appear more than once, so keep
+	// count to make sure exactly k values survive
+	remaining := int(k)
+	for _, v := range logits {
+		if v > threshold {
+			remaining--
+		}
+	}
 
-	for _, idx := range indices[k:] {
-		logits[idx] = math.NaN()
+	for i, v := range logits {
+		switch {
+		case v > threshold:
+			// keep
+		case v == threshold && remaining > 0:
+			remaining--
+		default:
+			logits[i] = math.NaN()
+		}
 	}
 
 	return logits, nil
@@ -94,26 +163,45 @@ func (p TopP) Sample(logits []float64) ([]float64, error) {
 		return nil, err
 	}
 
-	indices := make([]int, len(probs))
-	for i := range indices {
-		indices[i] = i
-	}
+	// Grow the number of candidate tokens, via quickselect, only as far as
+	// needed to cross p, instead of fully sorting the whole vocabulary.
+	values := make([]float64, len(probs))
+	threshold := 0.0
+	for m := 1; ; m = min(m*2, len(probs)) {
+		copy(values, probs)
+		threshold = quickselectDesc(values, m)
+
+		cumSum := 0.0
+		for _, v := range probs {
+			if v >= threshold {
+				cumSum += v
+			}
+		}
 
-	// sort in descending order
-	slices.SortFunc(indices, func(i, j int) int {
-		return cmp.Compare(probs[j], probs[i])
-	})
+		if cumSum > float64(p) || m == len(probs) {
+			break
+		}
+	}
 
+	// values[:m] holds the m largest probabilities; walk them in descending
+	// order so only the smallest prefix that crosses p survives
+	top := values[:m]
+	slices.SortFunc(top, func(a, b float64) int { return cmp.Compare(b, a) })
 	cumSum := 0.0
-	for i, idx := range indices {
-		cumSum += probs[idx]
+	for _, v := range top {
+		cumSum += v
+		threshold = v
 		if cumSum > float64(p) {
-			for _, idx := range indices[i+1:] {
-				logits[idx] = math.NaN()
-			}
 			break
 		}
 	}
+
+	for i, v := range probs {
+		if v < threshold {
+			logits[i] = math.NaN()
+		}
+	}
+
 	return logits, nil
 }
 
@@ -128,12 +216,8 @@ func (p MinP) Sample(logits []float64) ([]float64, error) {
 	if err != nil {
 		return nil, err
 	}
-	copiedProbs := make([]float64, len(probs))
-	copy(copiedProbs, probs)
 
-	slices.Sort(copiedProbs)
-
-	maxProb := copiedProbs[len(copiedProbs)-1]
+	maxProb := floats.Max(probs)
 	probThreshold := float64(p) * maxProb
 
 	for i := range probs {
@@ -145,13 +229,374 @@ func (p MinP) Sample(logits []float64) ([]float64, error) {
 	return logits, nil
 }
 
-type weighed struct{}
+// mirostatEstimationWindow is the number of highest-probability tokens used
+// to estimate the Zipf exponent s for Mirostat v1, matching the window used
+// by the reference implementation.
+const mirostatEstimationWindow = 100
+
+// Mirostat implements Mirostat v1 (Basu et al., 2020): a stateful Sampler
+// that adaptively truncates logits to the top-k tokens so that, on average,
+// the surprise (in bits) of the chosen token tracks a target value Tau. k is
+// re-estimated on every call from the current Zipf exponent of the
+// distribution, and the running estimate mu is refined after each token via
+// Accept.
+type Mirostat struct {
+	// Tau is the target surprise, in bits.
+	Tau float64
+	// Eta is the learning rate used to update mu after each token.
+	Eta float64
+
+	mu float64
+
+	// probs holds the last computed softmax distribution over the full
+	// vocabulary, kept around so Accept can look up the surprise of
+	// whichever token was ultimately chosen.
+	probs []float64
+}
 
-func Weighed() Sampler {
-	return weighed{}
+// NewMirostat returns a Mirostat sampler targeting surprise tau with
+// learning rate eta.
+func NewMirostat(tau, eta float64) *Mirostat {
+	m := &Mirostat{Tau: tau, Eta: eta}
+	m.Reset()
+	return m
 }
 
-func (s weighed) Sample(logits []float64) ([]float64, error) {
+// Reset restores mu to its initial value, discarding any state accumulated
+// from prior calls to Sample.
+func (m *Mirostat) Reset() {
+	m.mu = 2 * m.Tau
+	m.probs = nil
+}
+
+// Clone returns an independent copy of m, so the same starting parameters
+// can be reused across unrelated decoding streams without them sharing mu.
+func (m *Mirostat) Clone() Sampler {
+	c := *m
+	c.probs = nil
+	return &c
+}
+
+func (m *Mirostat) Sample(logits []float64) ([]float64, error) {
+	probs, err := computeSoftmax(logits)
+	if err != nil {
+		return nil, err
+	}
+
+	indices := make([]int, len(probs))
+	for i := range indices {
+		indices[i] = i
+	}
+	// sort in descending order of probability
+	slices.SortFunc(indices, func(i, j int) int {
+		return cmp.Compare(probs[j], probs[i])
+	})
+
+	n := mirostatEstimationWindow
+	if n > len(indices) {
+		n = len(indices)
+	}
+
+	var sNum, sDen float64
+	for i := 0; i < n; i++ {
+		logRank := math.Log(float64(i + 1))
+		logProb := math.Log(1 / probs[indices[i]])
+		sNum += logProb * logRank
+		sDen += logRank * logRank
+	}
+	s := sNum / sDen
+	epsHat := s - 1
+
+	k := math.Pow((epsHat*math.Pow(2, m.mu))/(1-math.Pow(float64(len(probs)), -epsHat)), 1/s)
+	kInt := int(math.Round(k))
+	if kInt < 1 {
+		kInt = 1
+	}
+	if kInt > len(indices) {
+		kInt = len(indices)
+	}
+
+	keep := make(map[int]struct{}, kInt)
+	for _, idx := range indices[:kInt] {
+		keep[idx] = struct{}{}
+	}
+	for i := range logits {
+		if _, ok := keep[i]; !ok {
+			logits[i] = math.NaN()
+		}
+	}
+
+	m.probs = probs
+	return logits, nil
+}
+
+// Accept folds the surprise of the chosen token into mu.
+func (m *Mirostat) Accept(tokenID int) error {
+	if m.probs == nil || tokenID < 0 || tokenID >= len(m.probs) {
+		return errors.New("mirostat: no distribution to accept token against")
+	}
+	surprise := -math.Log2(m.probs[tokenID])
+	m.mu -= m.Eta * (surprise - m.Tau)
+	return nil
+}
+
+// MirostatV2 implements Mirostat v2 (Basu et al., 2020). Unlike v1 it does
+// not re-estimate the Zipf exponent on every call: it simply keeps tokens
+// whose surprise does not exceed the running estimate mu.
+type MirostatV2 struct {
+	// Tau is the target surprise, in bits.
+	Tau float64
+	// Eta is the learning rate used to update mu after each token.
+	Eta float64
+
+	mu    float64
+	probs []float64
+}
+
+// NewMirostatV2 returns a MirostatV2 sampler targeting surprise tau with
+// learning rate eta.
+func NewMirostatV2(tau, eta float64) *MirostatV2 {
+	m := &MirostatV2{Tau: tau, Eta: eta}
+	m.Reset()
+	return m
+}
+
+// Reset restores mu to its initial value, discarding any state accumulated
+// from prior calls to Sample.
+func (m *MirostatV2) Reset() {
+	m.mu = 2 * m.Tau
+	m.probs = nil
+}
+
+// Clone returns an independent copy of m, so the same starting parameters
+// can be reused across unrelated decoding streams without them sharing mu.
+func (m *MirostatV2) Clone() Sampler {
+	c := *m
+	c.probs = nil
+	return &c
+}
+
+func (m *MirostatV2) Sample(logits []float64) ([]float64, error) {
+	probs, err := computeSoftmax(logits)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, p := range probs {
+		surprise := -math.Log2(p)
+		if surprise > m.mu {
+			logits[i] = math.NaN()
+		}
+	}
+
+	m.probs = probs
+	return logits, nil
+}
+
+// Accept folds the surprise of the chosen token into mu.
+func (m *MirostatV2) Accept(tokenID int) error {
+	if m.probs == nil || tokenID < 0 || tokenID >= len(m.probs) {
+		return errors.New("mirostat: no distribution to accept token against")
+	}
+	surprise := -math.Log2(m.probs[tokenID])
+	m.mu -= m.Eta * (surprise - m.Tau)
+	return nil
+}
+
+// TokenHistory is a fixed-size ring buffer of recently generated token ids.
+// It is updated externally as generation proceeds (via Observe) and can be
+// shared between several samplers in a chain, such as multiple Penalty
+// instances with different windows, so they don't each need to duplicate
+// the same bookkeeping.
+type TokenHistory struct {
+	tokens []int
+	pos    int
+	n      int
+}
+
+// NewTokenHistory returns a TokenHistory that remembers up to size of the
+// most recently observed tokens.
+func NewTokenHistory(size int) *TokenHistory {
+	return &TokenHistory{tokens: make([]int, size)}
+}
+
+// Observe records tokenID as the most recently generated token.
+func (h *TokenHistory) Observe(tokenID int) {
+	if len(h.tokens) == 0 {
+		return
+	}
+	h.tokens[h.pos] = tokenID
+	h.pos = (h.pos + 1) % len(h.tokens)
+	if h.n < len(h.tokens) {
+		h.n++
+	}
+}
+
+// Counts returns how often each token id appears in the last n observed
+// tokens. n is clamped to how many tokens have actually been observed; n <=
+// 0 (following the repeat_last_n convention of disabling the penalty
+// entirely) returns nil.
+func (h *TokenHistory) Counts(n int) map[int]int {
+	if n <= 0 {
+		return nil
+	}
+	if n > h.n {
+		n = h.n
+	}
+
+	counts := make(map[int]int, n)
+	for i := 0; i < n; i++ {
+		idx := (h.pos - 1 - i + len(h.tokens)) % len(h.tokens)
+		counts[h.tokens[idx]]++
+	}
+	return counts
+}
+
+// Reset discards all observed tokens.
+func (h *TokenHistory) Reset() {
+	h.pos = 0
+	h.n = 0
+}
+
+// Penalty penalizes logits for tokens seen in the last LastN generated
+// tokens, following the repetition-penalty convention used by most
+// inference servers: FrequencyPenalty and PresencePenalty are subtracted
+// directly, scaled by how many times (and whether) a token was seen, while
+// RepeatPenalty divides positive logits and multiplies negative ones.
+//
+// Penalty implements StatefulSampler: its Accept is called by Sample once a
+// terminal sampler has chosen a token, recording that token into History so
+// it is penalized on subsequent calls. Because Penalty only adjusts existing
+// logits rather than truncating the distribution, it should run before
+// Temperature, TopK and TopP in a sampler chain.
+type Penalty struct {
+	// History is the shared token history Penalty reads from and appends
+	// to. Multiple Penalty samplers (e.g. different LastN windows) may
+	// share the same History.
+	History *TokenHistory
+
+	LastN            int
+	RepeatPenalty    float64
+	FrequencyPenalty float64
+	PresencePenalty  float64
+}
+
+// NewPenalty returns a Penalty sampler reading from and appending to
+// history.
+func NewPenalty(history *TokenHistory, lastN int, repeatPenalty, frequencyPenalty, presencePenalty float64) *Penalty {
+	return &Penalty{
+		History:          history,
+		LastN:            lastN,
+		RepeatPenalty:    repeatPenalty,
+		FrequencyPenalty: frequencyPenalty,
+		PresencePenalty:  presencePenalty,
+	}
+}
+
+func (p *Penalty) Sample(logits []float64) ([]float64, error) {
+	if p.History == nil {
+		return logits, nil
+	}
+
+	for tokenID, count := range p.History.Counts(p.LastN) {
+		if tokenID < 0 || tokenID >= len(logits) {
+			continue
+		}
+
+		logits[tokenID] -= p.FrequencyPenalty*float64(count) + p.PresencePenalty
+		if p.RepeatPenalty > 0 {
+			if logits[tokenID] > 0 {
+				logits[tokenID] /= p.RepeatPenalty
+			} else {
+				logits[tokenID] *= p.RepeatPenalty
+			}
+		}
+	}
+
+	return logits, nil
+}
+
+// Accept records tokenID into History so it is penalized going forward.
+func (p *Penalty) Accept(tokenID int) error {
+	if p.History == nil {
+		return nil
+	}
+	p.History.Observe(tokenID)
+	return nil
+}
+
+// LogitBias adds a fixed additive bias to specific token ids' logits before
+// the rest of the sampling chain runs. A bias of +Inf forces that token (by
+// masking out every other token) and -Inf bans it outright, matching the
+// convention the rest of this package uses for excluded tokens.
+type LogitBias map[int]float64
+
+func (b LogitBias) Sample(logits []float64) ([]float64, error) {
+	for tokenID, bias := range b {
+		if tokenID < 0 || tokenID >= len(logits) {
+			continue
+		}
+
+		switch {
+		case math.IsInf(bias, 1):
+			for i := range logits {
+				logits[i] = math.NaN()
+			}
+			logits[tokenID] = 0
+		case math.IsInf(bias, -1):
+			logits[tokenID] = math.NaN()
+		default:
+			logits[tokenID] += bias
+		}
+	}
+
+	return logits, nil
+}
+
+// Seedable is implemented by samplers whose randomness can be pinned to a
+// deterministic source, so a decoding run can be reproduced bit-for-bit
+// given the same seed, prompt and sampler chain.
+type Seedable interface {
+	Seed(src rand.Source)
+}
+
+type weighed struct {
+	rand *rand.Rand
+}
+
+// WeighedOption configures a Sampler returned by Weighed.
+type WeighedOption func(*weighed)
+
+// WithSeed makes Weighed's sampling deterministic: the same seed and logits
+// always produce the same chosen token.
+func WithSeed(seed int64) WeighedOption {
+	return func(w *weighed) {
+		w.rand = rand.New(rand.NewSource(uint64(seed)))
+	}
+}
+
+// WithSource makes Weighed draw from src instead of the default global
+// source, e.g. to share a single seeded source across several samplers.
+func WithSource(src rand.Source) WeighedOption {
+	return func(w *weighed) {
+		w.rand = rand.New(src)
+	}
+}
+
+func Weighed(opts ...WeighedOption) Sampler {
+	w := &weighed{}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// Seed implements Seedable.
+func (s *weighed) Seed(src rand.Source) {
+	s.rand = rand.New(src)
+}
+
+func (s *weighed) Sample(logits []float64) ([]float64, error) {
 	logitsCopy := make([]float64, 0, len(logits))
 	indices := make([]int, 0, len(logits))
 	// the uv sampler does not support NaN values
@@ -171,7 +616,15 @@ func (s weighed) Sample(logits []float64) ([]float64, error) {
 		return nil, err
 	}
 
-	w := sampleuv.NewWeighted(logitsCopy, nil)
+	// a nil *rand.Rand, if passed as-is, would be a non-nil rand.Source
+	// interface wrapping a nil pointer; only forward it once it is set so
+	// sampleuv falls back to its own default global source
+	var src rand.Source
+	if s.rand != nil {
+		src = s.rand
+	}
+
+	w := sampleuv.NewWeighted(logitsCopy, src)
 	if v, ok := w.Take(); ok {
 		// returns the token ID
 		return []float64{float64(indices[v])}, nil
@@ -194,17 +647,57 @@ func Sample(logits []float64, samplers ...Sampler) ([]float64, error) {
 	var err error
 	for _, sampler := range samplers {
 		if sampler == Temperature(0) {
-			// early return with greedy if temperature is 0
+			// early cutover to greedy if temperature is 0; still falls
+			// through to the Accept dispatch below like any other
+			// terminal sampler would
 			logits, err = Greedy().Sample(logits)
 			if err != nil {
 				return nil, err
 			}
-			return logits, nil
+			break
 		}
 		logits, err = sampler.Sample(logits)
 		if err != nil {
 			return nil, err
 		}
 	}
+
+	// once a terminal sampler has collapsed logits down to a single chosen
+	// token id, let any stateful samplers in the chain fold that choice
+	// into their state; a TokenHistory shared by several Penalty samplers
+	// records the token only once
+	if len(logits) == 1 {
+		tokenID := int(logits[0])
+		observed := make(map[*TokenHistory]bool)
+		for _, sampler := range samplers {
+			if p, ok := sampler.(*Penalty); ok && p.History != nil {
+				if observed[p.History] {
+					continue
+				}
+				observed[p.History] = true
+			}
+			if ss, ok := sampler.(StatefulSampler); ok {
+				if err := ss.Accept(tokenID); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
 	return logits, nil
 }
+
+// SampleWithSeed behaves exactly like Sample, except it first seeds every
+// Seedable sampler in the chain from seed, so a caller can reproduce a full
+// generation bit-for-bit given the same seed, prompt and sampler chain.
+// Distinct seeds passed to concurrent calls do not interfere with each
+// other, since each seeds its own samplers' sources independently.
+func SampleWithSeed(seed int64, logits []float64, samplers ...Sampler) ([]float64, error) {
+	src := rand.NewSource(uint64(seed))
+	for _, sampler := range samplers {
+		if seedable, ok := sampler.(Seedable); ok {
+			seedable.Seed(src)
+		}
+	}
+	return Sample(logits, samplers...)
+}
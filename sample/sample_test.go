@@ -0,0 +1,342 @@
+package sample
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestTopK(t *testing.T) {
+	logits := []float64{0.1, 0.2, 0.3, 0.4, 0.5}
+	got, err := TopK(3).Sample(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept := 0
+	for _, v := range got {
+		if !math.IsNaN(v) {
+			kept++
+		}
+	}
+	if kept != 3 {
+		t.Errorf("expected 3 surviving logits, got %d", kept)
+	}
+	for _, want := range []float64{0.3, 0.4, 0.5} {
+		if math.IsNaN(logits[indexOf(logits, want)]) {
+			t.Errorf("expected %v to survive top-3", want)
+		}
+	}
+}
+
+func TestTopP(t *testing.T) {
+	logits := []float64{1, 2, 3, 4, 5}
+	got, err := TopP(0.5).Sample(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept := 0
+	for _, v := range got {
+		if !math.IsNaN(v) {
+			kept++
+		}
+	}
+	if kept != 1 {
+		t.Errorf("expected only the top token to cross p=0.5 cumulative probability, kept %d", kept)
+	}
+	if math.IsNaN(logits[indexOf(logits, 5)]) {
+		t.Errorf("expected the highest-probability token to survive TopP")
+	}
+}
+
+func TestMinP(t *testing.T) {
+	logits := []float64{1, 2, 3, 4, 5}
+	got, err := MinP(0.5).Sample(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept := 0
+	for _, v := range got {
+		if !math.IsNaN(v) {
+			kept++
+		}
+	}
+	if kept != 1 {
+		t.Errorf("expected only tokens within 0.5x the max probability to survive, kept %d", kept)
+	}
+	if math.IsNaN(logits[indexOf(logits, 5)]) {
+		t.Errorf("expected the highest-probability token to survive MinP")
+	}
+}
+
+func descendingLogits(n int) []float64 {
+	logits := make([]float64, n)
+	for i := range logits {
+		logits[i] = -float64(i)
+	}
+	return logits
+}
+
+func TestMirostatSampleTruncatesToASaneK(t *testing.T) {
+	m := NewMirostat(5.0, 0.1)
+	got, err := m.Sample(descendingLogits(200))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept := 0
+	for _, v := range got {
+		if !math.IsNaN(v) {
+			kept++
+		}
+	}
+	if kept == 0 || kept == len(got) {
+		t.Errorf("expected Mirostat to truncate to a proper subset, kept %d of %d", kept, len(got))
+	}
+}
+
+func TestMirostatAcceptMovesMuTowardTargetSurprise(t *testing.T) {
+	// Tau is set far below the surprise of any reasonably likely token, so
+	// accepting one must always push mu down.
+	m := NewMirostat(0.01, 0.1)
+	initialMu := m.mu
+
+	if _, err := m.Sample(descendingLogits(100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Accept(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.mu >= initialMu {
+		t.Errorf("expected mu to decrease when the chosen token's surprise exceeds Tau, got %v (was %v)", m.mu, initialMu)
+	}
+}
+
+func TestMirostatResetAndClone(t *testing.T) {
+	m := NewMirostat(5.0, 0.1)
+	if _, err := m.Sample(descendingLogits(100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Accept(0); err != nil {
+		t.Fatal(err)
+	}
+	if m.mu == 2*m.Tau {
+		t.Fatal("expected mu to have moved away from its initial value before Reset/Clone")
+	}
+
+	clone := m.Clone().(*Mirostat)
+	if clone.mu != m.mu {
+		t.Errorf("expected Clone to copy mu, got %v want %v", clone.mu, m.mu)
+	}
+
+	m.Reset()
+	if m.mu != 2*m.Tau {
+		t.Errorf("Reset did not restore mu, got %v", m.mu)
+	}
+	if clone.mu == m.mu {
+		t.Errorf("expected Reset on the original not to affect the clone")
+	}
+}
+
+func TestMirostatV2SampleAndAccept(t *testing.T) {
+	m := NewMirostatV2(5.0, 0.1)
+	got, err := m.Sample(descendingLogits(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept := 0
+	for _, v := range got {
+		if !math.IsNaN(v) {
+			kept++
+		}
+	}
+	if kept == 0 || kept == len(got) {
+		t.Errorf("expected MirostatV2 to truncate to a proper subset, kept %d of %d", kept, len(got))
+	}
+
+	if err := m.Accept(0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPenalty(t *testing.T) {
+	history := NewTokenHistory(64)
+	history.Observe(2)
+	history.Observe(2)
+	history.Observe(3)
+
+	p := NewPenalty(history, 64, 1.1, 0.5, 0.2)
+	logits := []float64{1, 1, 1, 1}
+	got, err := p.Sample(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// token 2 was seen twice: penalized by frequency*2 + presence, then
+	// multiplied by RepeatPenalty since the result has gone negative
+	want := (1 - (0.5*2 + 0.2)) * 1.1
+	if math.Abs(got[2]-want) > 1e-9 {
+		t.Errorf("logits[2] = %v, want %v", got[2], want)
+	}
+	if got[0] != 1 {
+		t.Errorf("logits[0] = %v, want unchanged 1", got[0])
+	}
+}
+
+func TestLogitBias(t *testing.T) {
+	b := LogitBias{1: math.Inf(-1), 2: 0.5}
+	got, err := b.Sample([]float64{1, 1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !math.IsNaN(got[1]) {
+		t.Errorf("expected token 1 to be banned, got %v", got[1])
+	}
+	if got[2] != 1.5 {
+		t.Errorf("logits[2] = %v, want 1.5", got[2])
+	}
+}
+
+func TestSampleWithSeedReproducible(t *testing.T) {
+	logits := func() []float64 { return []float64{0.1, 0.2, 0.3, 0.4, 0.5} }
+
+	first, err := SampleWithSeed(42, logits(), Weighed())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := SampleWithSeed(42, logits(), Weighed())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first[0] != second[0] {
+		t.Errorf("same seed produced different tokens: %v vs %v", first, second)
+	}
+}
+
+func TestSampleWithSeedConcurrentIndependence(t *testing.T) {
+	logits := func() []float64 { return []float64{0.1, 0.2, 0.3, 0.4, 0.5} }
+
+	run := func(seed int64) (float64, error) {
+		got, err := SampleWithSeed(seed, logits(), Weighed())
+		if err != nil {
+			return 0, err
+		}
+		return got[0], nil
+	}
+
+	seeds := []int64{1, 2, 3, 4}
+	want := make([]float64, len(seeds))
+	for i, seed := range seeds {
+		v, err := run(seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[i] = v
+	}
+
+	got := make([]float64, len(seeds))
+	errs := make([]error, len(seeds))
+	var wg sync.WaitGroup
+	for i, seed := range seeds {
+		wg.Add(1)
+		go func(i int, seed int64) {
+			defer wg.Done()
+			got[i], errs[i] = run(seed)
+		}(i, seed)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("seed %d: %v", seeds[i], err)
+		}
+	}
+
+	for i := range seeds {
+		if got[i] != want[i] {
+			t.Errorf("seed %d: concurrent result %v != serial result %v", seeds[i], got[i], want[i])
+		}
+	}
+}
+
+func indexOf(logits []float64, v float64) int {
+	for i, l := range logits {
+		if l == v {
+			return i
+		}
+	}
+	return -1
+}
+
+func benchmarkLogits(n int) []float64 {
+	r := rand.New(rand.NewSource(int64(n)))
+	logits := make([]float64, n)
+	for i := range logits {
+		logits[i] = r.NormFloat64()
+	}
+	return logits
+}
+
+func BenchmarkTopK(b *testing.B) {
+	for _, n := range []int{32000, 128000, 256000} {
+		logits := benchmarkLogits(n)
+		b.Run(itoa(n), func(b *testing.B) {
+			scratch := make([]float64, n)
+			for i := 0; i < b.N; i++ {
+				copy(scratch, logits)
+				if _, err := TopK(40).Sample(scratch); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkTopP(b *testing.B) {
+	for _, n := range []int{32000, 128000, 256000} {
+		logits := benchmarkLogits(n)
+		b.Run(itoa(n), func(b *testing.B) {
+			scratch := make([]float64, n)
+			for i := 0; i < b.N; i++ {
+				copy(scratch, logits)
+				if _, err := TopP(0.9).Sample(scratch); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMinP(b *testing.B) {
+	for _, n := range []int{32000, 128000, 256000} {
+		logits := benchmarkLogits(n)
+		b.Run(itoa(n), func(b *testing.B) {
+			scratch := make([]float64, n)
+			for i := 0; i < b.N; i++ {
+				copy(scratch, logits)
+				if _, err := MinP(0.1).Sample(scratch); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func itoa(n int) string {
+	switch n {
+	case 32000:
+		return "vocab=32k"
+	case 128000:
+		return "vocab=128k"
+	case 256000:
+		return "vocab=256k"
+	default:
+		return "vocab"
+	}
+}